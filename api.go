@@ -2,14 +2,17 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 // API is an interface to a UniFi controller.
@@ -18,6 +21,22 @@ type API struct {
 	cookieBase *url.URL
 	authStore  AuthStore
 	auth       *Auth
+	controller Controller
+
+	// totpProvider generates 2FA codes on login challenges. Defaults to
+	// DefaultTOTPProvider when nil.
+	totpProvider TOTPProvider
+
+	// limiter throttles outgoing requests to defaultRateLimit req/s.
+	limiter *rateLimiter
+
+	// metrics receives per-request instrumentation. Defaults to
+	// noopMetrics when nil.
+	metrics Metrics
+
+	// subsMu guards subs, the active Subscribe goroutines keyed by site.
+	subsMu sync.Mutex
+	subs   map[string]*eventSubscription
 }
 
 // Auth holds the authentication information for accessing a UniFi controller.
@@ -26,6 +45,24 @@ type Auth struct {
 	Password       string
 	ControllerHost string
 	Cookies        []*http.Cookie
+
+	// TOTPSecret is the base32-encoded RFC 6238 shared secret for accounts
+	// with 2FA enabled. Leave empty if the account has no 2FA.
+	TOTPSecret string
+
+	// TokenCookie holds the controller's longer-lived "TOKEN" session
+	// cookie issued after a successful MFA login, tracked separately from
+	// Cookies since it outlives the regular session cookie.
+	TokenCookie *http.Cookie
+
+	// CertPin is the "sha256/base64" SPKI pin of the controller's
+	// certificate, either configured up front or recorded by trust-on-
+	// first-use. Empty means no pinning.
+	CertPin string
+
+	// TLS configures certificate verification for the controller
+	// connection. The zero value performs normal system-trust validation.
+	TLS TLSConfig
 }
 
 // NewAPI constructs a new API.
@@ -44,26 +81,50 @@ func NewAPI(authStore AuthStore) (*API, error) {
 	}
 	jar.SetCookies(cookieBase, auth.Cookies)
 
-	api := &API{
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					// TODO: support proper certs
-					InsecureSkipVerify: true,
-				},
-			},
-			Jar: jar,
+	tlsConfig, err := buildTLSConfig(auth.TLS, auth, authStore)
+	if err != nil {
+		return nil, fmt.Errorf("configuring TLS: %v", err)
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
 		},
+		Jar: jar,
+	}
+
+	controller := detectController(httpClient, auth.ControllerHost)
+
+	api := &API{
+		httpClient: httpClient,
 		cookieBase: cookieBase,
 		authStore:  authStore,
 		auth:       auth,
+		controller: controller,
+		limiter:    newRateLimiter(defaultRateLimit),
+		metrics:    noopMetrics{},
 	}
 	return api, nil
 }
 
+// SetMetrics installs a Metrics implementation to receive per-request
+// instrumentation. Passing nil restores the no-op default.
+func (api *API) SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	api.metrics = m
+}
+
 // WriteConfig writes the configuration to the configured AuthStore.
 func (api *API) WriteConfig() error {
 	api.auth.Cookies = api.httpClient.Jar.Cookies(api.cookieBase)
+	for _, c := range api.auth.Cookies {
+		if c.Name == "TOKEN" {
+			api.auth.TokenCookie = c
+			break
+		}
+	}
 	return api.authStore.Save(api.auth)
 }
 
@@ -91,6 +152,14 @@ func (api *API) get(u string, dst interface{}, opts reqOpts) error {
 
 type reqOpts struct {
 	referer string
+
+	// MaxRetries caps retry attempts on 429/5xx responses. Zero means use
+	// defaultMaxRetries.
+	MaxRetries int
+
+	// Timeout bounds each individual HTTP attempt. Zero means use
+	// defaultTimeout.
+	Timeout time.Duration
 }
 
 func (api *API) processHttpRequest(req *http.Request, dst interface{}, opts reqOpts) error {
@@ -98,6 +167,15 @@ func (api *API) processHttpRequest(req *http.Request, dst interface{}, opts reqO
 		req.Header.Set("Referer", opts.referer)
 	}
 
+	maxRetries := opts.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
 	dec := struct {
 		Data interface{} `json:"data"`
 		Meta struct {
@@ -107,44 +185,95 @@ func (api *API) processHttpRequest(req *http.Request, dst interface{}, opts reqO
 	}{Data: dst}
 
 	triedLogin := false
-	for {
-		resp, err := api.httpClient.Do(req)
+	for attempt := 0; ; attempt++ {
+		if err := api.limiter.wait(req.Context()); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		attemptReq := req.WithContext(ctx)
+		api.controller.ApplyCSRF(attemptReq)
+
+		start := time.Now()
+		resp, err := api.httpClient.Do(attemptReq)
 		if err != nil {
+			cancel()
+			api.metrics.ObserveRequest(req.URL.Path, req.Method, 0, time.Since(start), "network")
 			return err
 		}
+		api.controller.CaptureCSRF(resp)
 		body, err := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
+		cancel()
 		if err != nil {
 			return err
 		}
 
-		if err := json.Unmarshal(body, &dec); err != nil {
-			return fmt.Errorf("parsing response body: %v", err)
-		}
-
 		if resp.StatusCode == 200 {
+			if err := json.Unmarshal(body, &dec); err != nil {
+				return fmt.Errorf("parsing response body: %v", err)
+			}
 			if dec.Meta.Code != "ok" {
+				if dec.Meta.Msg == ubic2faTokenRequired {
+					api.metrics.ObserveRequest(req.URL.Path, req.Method, resp.StatusCode, time.Since(start), "mfa-required")
+					return errMFARequired
+				}
+				api.metrics.ObserveRequest(req.URL.Path, req.Method, resp.StatusCode, time.Since(start), "")
 				return fmt.Errorf("non-ok return code %q (%s)", dec.Meta.Code, dec.Meta.Msg)
 			}
+			api.metrics.ObserveRequest(req.URL.Path, req.Method, resp.StatusCode, time.Since(start), "")
 			return nil
 		}
 
+		// Best-effort decode: the controller's error bodies (400/401/etc.)
+		// use the same {meta:{rc,msg}} envelope, but may not always match
+		// it, so a decode failure here isn't itself an error.
+		dec.Meta.Code, dec.Meta.Msg = "", ""
+		_ = json.Unmarshal(body, &dec)
+
+		if dec.Meta.Msg == ubic2faTokenRequired {
+			api.metrics.ObserveRequest(req.URL.Path, req.Method, resp.StatusCode, time.Since(start), "mfa-required")
+			return errMFARequired
+		}
+
 		if resp.StatusCode == http.StatusUnauthorized && !triedLogin { // 401
 			if dec.Meta.Code == "error" && dec.Meta.Msg == "api.err.LoginRequired" {
+				api.metrics.ObserveRequest(req.URL.Path, req.Method, resp.StatusCode, time.Since(start), "unauthorized")
 				if err := api.login(); err != nil {
 					return err
 				}
 				triedLogin = true
+				if req.GetBody != nil {
+					if body, err := req.GetBody(); err == nil {
+						req.Body = body
+					}
+				}
 				continue
 			}
 		}
 
+		api.metrics.ObserveRequest(req.URL.Path, req.Method, resp.StatusCode, time.Since(start), errCategoryForStatus(resp.StatusCode))
+
+		if retryableStatus(resp.StatusCode) && attempt < maxRetries {
+			select {
+			case <-time.After(retryDelay(attempt)):
+			case <-req.Context().Done():
+				return req.Context().Err()
+			}
+			if req.GetBody != nil {
+				if body, err := req.GetBody(); err == nil {
+					req.Body = body
+				}
+			}
+			continue
+		}
+
 		return fmt.Errorf("HTTP response %s", resp.Status)
 	}
 }
 
 func (api *API) baseURL() string {
-	return "https://" + api.auth.ControllerHost + ":8443"
+	return api.controller.BaseURL(api.auth.ControllerHost)
 }
 
 func (api *API) login() error {
@@ -155,14 +284,18 @@ func (api *API) login() error {
 		Username: api.auth.Username,
 		Password: api.auth.Password,
 	}
-	return api.post("/api/login", &req, &json.RawMessage{}, reqOpts{
+	err := api.post(api.controller.LoginPath(), &req, &json.RawMessage{}, reqOpts{
 		referer: api.baseURL() + "/login",
 	})
+	if errors.Is(err, errMFARequired) {
+		return api.loginWithMFA()
+	}
+	return err
 }
 
 func (api *API) ListClients(site string) ([]Client, error) {
 	var resp []Client
-	if err := api.get("/api/s/"+site+"/stat/sta", &resp, reqOpts{}); err != nil {
+	if err := api.get(api.controller.SitePath(site, "/stat/sta"), &resp, reqOpts{}); err != nil {
 		return nil, err
 	}
 	return resp, nil
@@ -176,7 +309,7 @@ func (api *API) BlockClient(site string, mac string) error {
 		Cmd: "block-sta",
 		Mac: strings.ToUpper(mac),
 	}
-	err := api.post("/api/s/"+site+"/cmd/stamgr", &request, &json.RawMessage{}, reqOpts{})
+	err := api.post(api.controller.SitePath(site, "/cmd/stamgr"), &request, &json.RawMessage{}, reqOpts{})
 	if err != nil {
 		return err
 	}
@@ -191,7 +324,7 @@ func (api *API) UnblockClient(site string, mac string) error {
 		Cmd: "unblock-sta", //only diff with above function
 		Mac: strings.ToUpper(mac),
 	}
-	err := api.post("/api/s/"+site+"/cmd/stamgr", &request, &json.RawMessage{}, reqOpts{})
+	err := api.post(api.controller.SitePath(site, "/cmd/stamgr"), &request, &json.RawMessage{}, reqOpts{})
 	if err != nil {
 		return err
 	}
@@ -200,7 +333,7 @@ func (api *API) UnblockClient(site string, mac string) error {
 
 func (api *API) ListWirelessNetworks(site string) ([]WirelessNetwork, error) {
 	var resp []WirelessNetwork
-	err := api.get("/api/s/"+site+"/list/wlanconf", &resp, reqOpts{})
+	err := api.get(api.controller.SitePath(site, "/list/wlanconf"), &resp, reqOpts{})
 	if err != nil {
 		return nil, err
 	}
@@ -211,5 +344,5 @@ func (api *API) EnableWirelessNetwork(site, id string, enable bool) error {
 	req := struct {
 		Enabled bool `json:"enabled"`
 	}{enable}
-	return api.post("/api/s/"+site+"/upd/wlanconf/"+id, &req, &json.RawMessage{}, reqOpts{})
-}
\ No newline at end of file
+	return api.post(api.controller.SitePath(site, "/upd/wlanconf/"+id), &req, &json.RawMessage{}, reqOpts{})
+}
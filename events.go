@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// EventType identifies the kind of change reported by the controller's
+// event WebSocket.
+type EventType string
+
+const (
+	// EventClientConnect fires when a client associates or joins the network.
+	EventClientConnect EventType = "client.connect"
+	// EventClientDisconnect fires when a client disassociates or leaves.
+	EventClientDisconnect EventType = "client.disconnect"
+	// EventClientRoam fires when a client roams between APs.
+	EventClientRoam EventType = "client.roam"
+	// EventClientBlocked fires when a client is blocked via BlockClient.
+	EventClientBlocked EventType = "client.blocked"
+	// EventClientUnblocked fires when a client is unblocked via UnblockClient.
+	EventClientUnblocked EventType = "client.unblocked"
+)
+
+// Event is a single decoded message from the controller's event stream.
+type Event struct {
+	Type EventType
+	Mac  string
+	Raw  json.RawMessage
+}
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+)
+
+// rawEventMessage mirrors the envelope UniFi controllers use for
+// `/wss/s/{site}/events` messages.
+type rawEventMessage struct {
+	Meta struct {
+		Message string `json:"message"`
+	} `json:"meta"`
+	Data []struct {
+		Key string `json:"key"`
+		Mac string `json:"mac"`
+	} `json:"data"`
+}
+
+func (m rawEventMessage) eventType() (EventType, bool) {
+	switch {
+	case strings.Contains(m.Meta.Message, "sta:sync"):
+		return EventClientRoam, true
+	case strings.HasSuffix(m.Meta.Message, ":connected"):
+		return EventClientConnect, true
+	case strings.HasSuffix(m.Meta.Message, ":disconnected"):
+		return EventClientDisconnect, true
+	case strings.Contains(m.Meta.Message, "sta:block"):
+		return EventClientBlocked, true
+	case strings.Contains(m.Meta.Message, "sta:unblock"):
+		return EventClientUnblocked, true
+	default:
+		return "", false
+	}
+}
+
+// Subscribe opens the controller's event WebSocket for site and streams
+// decoded client connect/disconnect, roaming, and block/unblock events into
+// the returned channel. The connection automatically re-logs in and
+// reconnects (with backoff) on session expiry or drop, until Unsubscribe is
+// called for site.
+func (api *API) Subscribe(site string) (<-chan Event, error) {
+	// Unsubscribe any previous subscription for site first so its
+	// goroutine can't be leaked by being overwritten below.
+	api.Unsubscribe(site)
+
+	conn, err := api.dialEvents(site)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Event)
+	sub := &eventSubscription{cancel: cancel, done: make(chan struct{})}
+	sub.setConn(conn)
+
+	api.subsMu.Lock()
+	if api.subs == nil {
+		api.subs = make(map[string]*eventSubscription)
+	}
+	api.subs[site] = sub
+	api.subsMu.Unlock()
+
+	go api.runEventLoop(ctx, site, conn, events, sub)
+	return events, nil
+}
+
+// eventSubscription tracks the goroutine backing a single Subscribe call.
+type eventSubscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// connMu guards conn, which runEventLoop repoints at the new connection
+	// on every reconnect, so Unsubscribe can always close whichever
+	// connection is currently live.
+	connMu sync.Mutex
+	conn   *websocket.Conn
+}
+
+func (s *eventSubscription) setConn(conn *websocket.Conn) {
+	s.connMu.Lock()
+	s.conn = conn
+	s.connMu.Unlock()
+}
+
+func (s *eventSubscription) closeConn() {
+	s.connMu.Lock()
+	conn := s.conn
+	s.connMu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Unsubscribe tears down the event stream opened by Subscribe for site and
+// waits for its goroutine to exit. It is a no-op if site has no active
+// subscription.
+func (api *API) Unsubscribe(site string) {
+	api.subsMu.Lock()
+	sub, ok := api.subs[site]
+	delete(api.subs, site)
+	api.subsMu.Unlock()
+	if ok {
+		sub.cancel()
+		// cancel alone doesn't interrupt a blocking ReadMessage; close the
+		// live connection too so runEventLoop unblocks immediately instead
+		// of waiting out the read deadline.
+		sub.closeConn()
+		<-sub.done
+	}
+}
+
+func (api *API) dialEvents(site string) (*websocket.Conn, error) {
+	base, err := url.Parse(api.baseURL())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base URL: %v", err)
+	}
+	u := url.URL{
+		Scheme: "wss",
+		Host:   base.Host,
+		Path:   api.controller.WSPath(site),
+	}
+	header := make(map[string][]string)
+	for _, c := range api.httpClient.Jar.Cookies(api.cookieBase) {
+		header.Add("Cookie", c.String())
+	}
+
+	dialer := websocket.Dialer{TLSClientConfig: api.httpClient.Transport.(*http.Transport).TLSClientConfig}
+	conn, _, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, fmt.Errorf("dialing event websocket: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	return conn, nil
+}
+
+// reconnectEvents re-logs in and redials the event websocket for site,
+// retrying with backoff until it succeeds or ctx is canceled.
+func (api *API) reconnectEvents(ctx context.Context, site string) (*websocket.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		if err := api.login(); err == nil {
+			if conn, err := api.dialEvents(site); err == nil {
+				return conn, nil
+			}
+		}
+
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (api *API) runEventLoop(ctx context.Context, site string, conn *websocket.Conn, events chan<- Event, sub *eventSubscription) {
+	defer close(sub.done)
+	defer close(events)
+	defer conn.Close()
+
+	go api.keepalive(ctx, conn)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			// A read error triggered by Unsubscribe closing conn is not a
+			// drop to recover from; bail out before redialing.
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			newConn, err := api.reconnectEvents(ctx, site)
+			if err != nil {
+				return
+			}
+			conn = newConn
+			sub.setConn(conn)
+			go api.keepalive(ctx, conn)
+			continue
+		}
+
+		var raw rawEventMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			continue
+		}
+		typ, ok := raw.eventType()
+		if !ok {
+			continue
+		}
+		for _, d := range raw.Data {
+			select {
+			case events <- Event{Type: typ, Mac: strings.ToUpper(d.Mac), Raw: body}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (api *API) keepalive(ctx context.Context, conn *websocket.Conn) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
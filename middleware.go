@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Metrics receives per-endpoint instrumentation for controller requests, so
+// callers can export counters, latencies, and error categories to something
+// like Prometheus.
+type Metrics interface {
+	// ObserveRequest is called once per HTTP attempt (including retries).
+	// errCategory is "" on success, or one of "timeout", "rate-limited",
+	// "server-error", "network" on failure.
+	ObserveRequest(endpoint, method string, statusCode int, duration time.Duration, errCategory string)
+}
+
+// noopMetrics discards all observations; it is the default when no Metrics
+// implementation is configured.
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveRequest(string, string, int, time.Duration, string) {}
+
+const (
+	defaultRateLimit  = 5 // requests per second
+	defaultMaxRetries = 3
+	defaultTimeout    = 10 * time.Second
+
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// rateLimiter is a simple token-bucket limiter used to keep request volume
+// under the controller's abuse-detection threshold.
+type rateLimiter struct {
+	tokens chan struct{}
+}
+
+// newRateLimiter starts a limiter that admits ratePerSecond requests/sec.
+func newRateLimiter(ratePerSecond int) *rateLimiter {
+	rl := &rateLimiter{tokens: make(chan struct{}, ratePerSecond)}
+	for i := 0; i < ratePerSecond; i++ {
+		rl.tokens <- struct{}{}
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second / time.Duration(ratePerSecond))
+		defer ticker.Stop()
+		for range ticker.C {
+			select {
+			case rl.tokens <- struct{}{}:
+			default: // bucket already full
+			}
+		}
+	}()
+	return rl
+}
+
+// wait blocks until a token is available or ctx is done.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	select {
+	case <-rl.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryDelay returns the exponential backoff delay (with jitter) before
+// retry attempt n (0-indexed), capped at retryMaxDelay.
+func retryDelay(n int) time.Duration {
+	delay := retryBaseDelay << uint(n)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+// retryableStatus reports whether statusCode warrants a retry.
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+func errCategoryForStatus(statusCode int) string {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return "rate-limited"
+	case statusCode >= 500:
+		return "server-error"
+	default:
+		return ""
+	}
+}
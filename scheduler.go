@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TimeWindow is a single allowed period within a day, expressed as minutes
+// since midnight in the rule's Timezone. A client is allowed online during
+// [Start, End) and blocked otherwise.
+type TimeWindow struct {
+	Start int // minutes since midnight, inclusive
+	End   int // minutes since midnight, exclusive
+}
+
+// contains reports whether minute-of-day m falls within the window.
+func (w TimeWindow) contains(m int) bool {
+	return m >= w.Start && m < w.End
+}
+
+// Rule describes the allowed online hours for a single client.
+type Rule struct {
+	MAC      string
+	Site     string
+	Allow    []TimeWindow
+	Timezone string // IANA zone name, e.g. "America/Los_Angeles"
+}
+
+// allowedAt reports whether the rule permits the client online at t.
+func (r Rule) allowedAt(t time.Time) (bool, error) {
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return false, fmt.Errorf("loading timezone %q for rule %s: %v", r.Timezone, r.MAC, err)
+	}
+	local := t.In(loc)
+	minuteOfDay := local.Hour()*60 + local.Minute()
+	for _, w := range r.Allow {
+		if w.contains(minuteOfDay) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Scheduler drives block/unblock transitions for a set of Rules, polling
+// periodically so transitions happen close to their scheduled boundary and
+// catching up any state drift (e.g. after the daemon was down) on startup.
+type Scheduler struct {
+	api       *API
+	authStore AuthStore
+	rules     []Rule
+	interval  time.Duration
+
+	// stateMu guards state, the last block/unblock decision applied per
+	// rule, so evaluateRule only calls the API again on a transition
+	// rather than every poll.
+	stateMu sync.Mutex
+	state   map[ruleKey]bool
+}
+
+// ruleKey identifies a rule for state tracking, independent of its position
+// in Scheduler.rules.
+type ruleKey struct {
+	Site string
+	MAC  string
+}
+
+func keyFor(r Rule) ruleKey {
+	return ruleKey{Site: r.Site, MAC: r.MAC}
+}
+
+// defaultPollInterval is how often the Scheduler re-evaluates every rule.
+const defaultPollInterval = time.Minute
+
+// NewScheduler constructs a Scheduler that drives block/unblock transitions
+// via api, persisting rule state through authStore.
+func NewScheduler(api *API, authStore AuthStore) (*Scheduler, error) {
+	rules, err := authStore.LoadRules()
+	if err != nil {
+		return nil, err
+	}
+	return &Scheduler{
+		api:       api,
+		authStore: authStore,
+		rules:     rules,
+		interval:  defaultPollInterval,
+		state:     make(map[ruleKey]bool),
+	}, nil
+}
+
+// Rules returns the scheduler's current rule set.
+func (s *Scheduler) Rules() []Rule {
+	return s.rules
+}
+
+// AddRule adds or replaces (by MAC+Site) a rule and persists the change.
+func (s *Scheduler) AddRule(r Rule) error {
+	for i, existing := range s.rules {
+		if existing.MAC == r.MAC && existing.Site == r.Site {
+			s.rules[i] = r
+			return s.authStore.SaveRules(s.rules)
+		}
+	}
+	s.rules = append(s.rules, r)
+	return s.authStore.SaveRules(s.rules)
+}
+
+// RemoveRule deletes the rule for mac/site, if any, and persists the change.
+func (s *Scheduler) RemoveRule(site, mac string) error {
+	for i, existing := range s.rules {
+		if existing.MAC == mac && existing.Site == site {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			s.stateMu.Lock()
+			delete(s.state, keyFor(existing))
+			s.stateMu.Unlock()
+			return s.authStore.SaveRules(s.rules)
+		}
+	}
+	return nil
+}
+
+// Run evaluates all rules immediately (so a client that should currently be
+// blocked gets blocked even if the daemon was down through that boundary),
+// then continues to re-evaluate every poll interval until ctx is canceled.
+// A single rule's error is logged and does not stop the scheduler.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.evaluateAll(time.Now())
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			s.evaluateAll(now)
+		}
+	}
+}
+
+func (s *Scheduler) evaluateAll(now time.Time) {
+	for _, r := range s.rules {
+		if err := s.evaluateRule(r, now); err != nil {
+			log.Printf("scheduler: evaluating rule for %s/%s: %v", r.Site, r.MAC, err)
+		}
+	}
+}
+
+// evaluateRule applies r's block/unblock state for now, but only calls the
+// API when that state has actually changed since the last evaluation.
+func (s *Scheduler) evaluateRule(r Rule, now time.Time) error {
+	allowed, err := r.allowedAt(now)
+	if err != nil {
+		return err
+	}
+
+	key := keyFor(r)
+	s.stateMu.Lock()
+	last, known := s.state[key]
+	s.stateMu.Unlock()
+	if known && last == allowed {
+		return nil
+	}
+
+	if allowed {
+		err = s.api.UnblockClient(r.Site, r.MAC)
+	} else {
+		err = s.api.BlockClient(r.Site, r.MAC)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.stateMu.Lock()
+	s.state[key] = allowed
+	s.stateMu.Unlock()
+	return nil
+}
+
+// RulesHandler returns an http.Handler implementing CRUD on the scheduler's
+// rules: GET lists the current rules, POST adds or replaces one, and DELETE
+// removes the rule identified by the "site" and "mac" query parameters.
+func (s *Scheduler) RulesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.Rules())
+
+		case http.MethodPost:
+			var r Rule
+			if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.AddRule(r); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, r)
+
+		case http.MethodDelete:
+			site, mac := req.URL.Query().Get("site"), req.URL.Query().Get("mac")
+			if err := s.RemoveRule(site, mac); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}